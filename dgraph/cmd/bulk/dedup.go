@@ -0,0 +1,163 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc.
+ *
+ * This file is available under the Apache License, Version 2.0,
+ * with the Commons Clause restriction.
+ */
+
+package bulk
+
+import (
+	"bytes"
+	"container/list"
+	"math/bits"
+	"sync"
+
+	farm "github.com/dgryski/go-farm"
+)
+
+// defaultDedupCacheMB is used when --map-dedup-cache-mb is unset or zero.
+const defaultDedupCacheMB = 16
+
+// dedupEntryBookkeepingOverhead is the fixed per-entry cost (map bucket plus
+// list node) charged against the cache budget on top of an entry's actual
+// content length, since content length alone would undercount the cache's
+// real memory footprint for small entries.
+const dedupEntryBookkeepingOverhead = 64
+
+// maxDedupContentLen caps how many content bytes a single entry can charge
+// against the cache budget. Predicates with large values (long strings,
+// many facets) would otherwise let one entry consume an outsized share of
+// --map-dedup-cache-mb; entries longer than this are still fingerprinted and
+// cached, just with their budget cost clamped, so one oversized posting
+// can't starve the cache for every other predicate.
+const maxDedupContentLen = 4096
+
+// dedupCacheEntry is what entryDedup keeps per cached fingerprint: the
+// fingerprint itself (so eviction can find its map entry) and a copy of the
+// exact bytes it was computed over, so a fingerprint match can be confirmed
+// before anything gets dropped.
+type dedupCacheEntry struct {
+	fp      uint64
+	content []byte
+}
+
+// budget returns how much of the cache's byte budget this entry charges:
+// its (possibly clamped) content length plus the fixed bookkeeping overhead.
+func (ce *dedupCacheEntry) budget() int64 {
+	n := len(ce.content)
+	if n > maxDedupContentLen {
+		n = maxDedupContentLen
+	}
+	return int64(n) + dedupEntryBookkeepingOverhead
+}
+
+// entryDedup is a bounded LRU of recently-seen entries, used as a pre-filter
+// in mapper.addMapEntry: if a fresh entry's fingerprint matches a cached one
+// *and* its content matches byte-for-byte, it's a genuine duplicate (repeated
+// index posting, repeated `_predicate_` entry, etc.) and can be dropped
+// before it ever reaches entriesBuf. A fingerprint match alone is never
+// enough to drop an entry — at the billions-of-postings scale this cache is
+// meant for, 64-bit fingerprint collisions between distinct entries stop
+// being negligible, and dropping a distinct posting would be silent data
+// loss. On a collision the entry is kept (and the cache slot is refreshed to
+// the newer content, so a genuine repeat of it is still caught later).
+// Misses caused by eviction just fall through to the exact, sort-based
+// collapse in writeMapEntriesToFile, so correctness never depends on this
+// cache either way — it only affects how much redundant data makes it into
+// entriesBuf before that pass runs.
+//
+// The cache is bounded by accumulated content bytes (via budget), not by
+// entry count: predicates with long string values or many facets store
+// proportionally more per entry, and a flat per-entry cost would let those
+// blow well past --map-dedup-cache-mb's configured budget.
+type entryDedup struct {
+	mu     sync.Mutex
+	budget int64 // Total byte budget; evict until used <= budget.
+	used   int64
+	ll     *list.List
+	index  map[uint64]*list.Element
+}
+
+func newEntryDedup(cacheMB int) *entryDedup {
+	if cacheMB <= 0 {
+		cacheMB = defaultDedupCacheMB
+	}
+	return &entryDedup{
+		budget: int64(cacheMB) << 20,
+		ll:     list.New(),
+		index:  make(map[uint64]*list.Element),
+	}
+}
+
+// seen reports whether content was already in the cache under fingerprint
+// fp, inserting or refreshing the cache slot either way. content is only
+// ever read, never retained by reference — seen copies it before storing.
+func (d *entryDedup) seen(fp uint64, content []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.index[fp]; ok {
+		ce := el.Value.(*dedupCacheEntry)
+		d.ll.MoveToFront(el)
+		if bytes.Equal(ce.content, content) {
+			return true
+		}
+		// Fingerprint collision between distinct entries: not a duplicate,
+		// but refresh the slot so a genuine repeat of this newer entry is
+		// still caught.
+		d.used -= ce.budget()
+		ce.content = append(ce.content[:0], content...)
+		d.used += ce.budget()
+		d.evict()
+		return false
+	}
+
+	ce := &dedupCacheEntry{fp: fp, content: append([]byte(nil), content...)}
+	d.index[fp] = d.ll.PushFront(ce)
+	d.used += ce.budget()
+	d.evict()
+	return false
+}
+
+// evict drops the least recently used entries until used is back within
+// budget, always keeping at least one entry so a single entry larger than
+// the whole budget doesn't leave the cache permanently empty.
+func (d *entryDedup) evict() {
+	for d.used > d.budget && d.ll.Len() > 1 {
+		oldest := d.ll.Back()
+		d.ll.Remove(oldest)
+		ce := oldest.Value.(*dedupCacheEntry)
+		delete(d.index, ce.fp)
+		d.used -= ce.budget()
+	}
+}
+
+// buzhashTable is a fixed per-byte-value table for a Buzhash-style rolling
+// checksum, the same construction containers/storage's content-defined
+// chunker uses to fingerprint byte runs when looking for repeated content.
+// We don't need a sliding window here, since each MapEntry is fingerprinted
+// as a whole rather than chunked, but reusing the construction keeps the
+// fingerprint cheap and well-mixed.
+var buzhashTable = func() [256]uint64 {
+	var t [256]uint64
+	h := farm.Fingerprint64([]byte("dgraph-bulk-map-dedup"))
+	for i := range t {
+		h = h*1099511628211 + uint64(i)
+		t[i] = h
+	}
+	return t
+}()
+
+// rollingFingerprint combines the bytes of parts (e.g. an entry's key and
+// its posting payload) into a single 64-bit fingerprint via the rolling
+// buzhash construction above.
+func rollingFingerprint(parts ...[]byte) uint64 {
+	var h uint64
+	for _, p := range parts {
+		for _, b := range p {
+			h = bits.RotateLeft64(h, 1) ^ buzhashTable[b]
+		}
+	}
+	return h
+}
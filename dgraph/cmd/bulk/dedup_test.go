@@ -0,0 +1,173 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc.
+ *
+ * This file is available under the Apache License, Version 2.0,
+ * with the Commons Clause restriction.
+ */
+
+package bulk
+
+import (
+	"container/list"
+	"testing"
+
+	"github.com/dgraph-io/dgraph/protos/intern"
+)
+
+func TestEntryDedupSeenMarksRepeats(t *testing.T) {
+	d := newEntryDedup(defaultDedupCacheMB)
+
+	if d.seen(1, []byte("a")) {
+		t.Fatal("first sighting of fp 1 reported as already seen")
+	}
+	if !d.seen(1, []byte("a")) {
+		t.Fatal("repeat of (fp 1, \"a\") not reported as seen")
+	}
+}
+
+func TestEntryDedupCollisionKeepsDistinctContent(t *testing.T) {
+	d := newEntryDedup(defaultDedupCacheMB)
+
+	if d.seen(42, []byte("a")) {
+		t.Fatal("first sighting of fp 42 reported as already seen")
+	}
+	// Same fingerprint, different content: a collision, not a duplicate, so
+	// it must NOT be reported as seen.
+	if d.seen(42, []byte("b")) {
+		t.Fatal("fingerprint collision between distinct content reported as a duplicate")
+	}
+	// The cache slot should have refreshed to the newer content ("b"), so a
+	// genuine repeat of it is still caught...
+	if !d.seen(42, []byte("b")) {
+		t.Fatal("repeat of the post-collision content not reported as seen")
+	}
+	// ...while the original content under that fingerprint is now a miss
+	// again, not a false-positive duplicate.
+	if d.seen(42, []byte("a")) {
+		t.Fatal("stale content from before a collision reported as a duplicate")
+	}
+}
+
+func TestEntryDedupEvictsOldest(t *testing.T) {
+	d := &entryDedup{
+		budget: 2 * (1 + dedupEntryBookkeepingOverhead), // Room for 2 one-byte entries.
+		ll:     list.New(),
+		index:  make(map[uint64]*list.Element),
+	}
+
+	d.seen(1, []byte("a"))
+	d.seen(2, []byte("b"))
+	d.seen(3, []byte("c")) // Evicts fp 1, the least recently used.
+
+	// Check fp 2 first: seen re-inserts a missing fingerprint, so probing fp 1
+	// first would itself evict fp 2.
+	if !d.seen(2, []byte("b")) {
+		t.Fatal("fingerprint 2 evicted even though it was more recently used than 1")
+	}
+	if d.seen(1, []byte("a")) {
+		t.Fatal("evicted fingerprint still reported as seen")
+	}
+}
+
+func TestEntryDedupRecencyProtectsFromEviction(t *testing.T) {
+	d := &entryDedup{
+		budget: 2 * (1 + dedupEntryBookkeepingOverhead), // Room for 2 one-byte entries.
+		ll:     list.New(),
+		index:  make(map[uint64]*list.Element),
+	}
+
+	d.seen(1, []byte("a"))
+	d.seen(2, []byte("b"))
+	d.seen(1, []byte("a")) // Touches fp 1, making fp 2 the least recently used.
+	d.seen(3, []byte("c")) // Evicts fp 2, not fp 1.
+
+	if !d.seen(1, []byte("a")) {
+		t.Fatal("recently-touched fingerprint was evicted")
+	}
+	if d.seen(2, []byte("b")) {
+		t.Fatal("least recently used fingerprint survived eviction")
+	}
+}
+
+func TestEntryDedupBudgetScalesWithContentLength(t *testing.T) {
+	d := newEntryDedup(1) // 1 MB budget.
+
+	small := make([]byte, 8)
+	d.seen(1, small)
+	if d.used != int64(len(small))+dedupEntryBookkeepingOverhead {
+		t.Fatalf("got used %d for an %d-byte entry, want %d",
+			d.used, len(small), int64(len(small))+dedupEntryBookkeepingOverhead)
+	}
+
+	// A much larger entry (e.g. a predicate with a long string value) should
+	// charge proportionally more against the budget, not the same flat cost
+	// a small entry does.
+	large := make([]byte, 2048)
+	d.seen(2, large)
+	if d.used <= int64(len(small))+dedupEntryBookkeepingOverhead {
+		t.Fatal("large content entry did not increase used budget proportionally")
+	}
+}
+
+func TestEntryDedupContentLengthIsCapped(t *testing.T) {
+	d := newEntryDedup(1)
+
+	oversized := make([]byte, maxDedupContentLen*4)
+	d.seen(1, oversized)
+
+	want := int64(maxDedupContentLen) + dedupEntryBookkeepingOverhead
+	if d.used != want {
+		t.Fatalf("got used %d for an oversized entry, want %d (content length capped at %d)",
+			d.used, want, maxDedupContentLen)
+	}
+}
+
+func TestCollapseDuplicateEntries(t *testing.T) {
+	entries := []*intern.MapEntry{
+		{Key: []byte("a"), Uid: 1},
+		{Key: []byte("a"), Uid: 1},
+		{Key: []byte("a"), Uid: 1},
+		{Key: []byte("a"), Uid: 2},
+		{Key: []byte("b"), Uid: 1},
+	}
+
+	out, collapsed := collapseDuplicateEntries(entries)
+	if collapsed != 2 {
+		t.Fatalf("got %d collapsed, want 2", collapsed)
+	}
+	want := []*intern.MapEntry{
+		{Key: []byte("a"), Uid: 1},
+		{Key: []byte("a"), Uid: 2},
+		{Key: []byte("b"), Uid: 1},
+	}
+	if len(out) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(out), len(want))
+	}
+	for i := range want {
+		if !sameMapEntry(out[i], want[i]) {
+			t.Fatalf("entry %d: got %v, want %v", i, out[i], want[i])
+		}
+	}
+}
+
+func TestSameMapEntryComparesPostingUID(t *testing.T) {
+	a := &intern.MapEntry{Key: []byte("k"), Posting: &intern.Posting{Uid: 7}}
+	b := &intern.MapEntry{Key: []byte("k"), Posting: &intern.Posting{Uid: 7}}
+	c := &intern.MapEntry{Key: []byte("k"), Posting: &intern.Posting{Uid: 8}}
+
+	if !sameMapEntry(a, b) {
+		t.Fatal("entries with the same key and posting UID reported as different")
+	}
+	if sameMapEntry(a, c) {
+		t.Fatal("entries with different posting UIDs reported as the same")
+	}
+}
+
+func TestSameMapEntryDifferentKeys(t *testing.T) {
+	a := &intern.MapEntry{Key: []byte("k1"), Uid: 1}
+	b := &intern.MapEntry{Key: []byte("k2"), Uid: 1}
+
+	if sameMapEntry(a, b) {
+		t.Fatal("entries with different keys reported as the same")
+	}
+}
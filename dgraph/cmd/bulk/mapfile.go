@@ -0,0 +1,342 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc.
+ *
+ * This file is available under the Apache License, Version 2.0,
+ * with the Commons Clause restriction.
+ */
+
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/DataDog/zstd"
+	"github.com/dgraph-io/dgraph/x"
+	"github.com/pkg/errors"
+)
+
+// Map files written by this package carry a trailer identifying them as the
+// compressed, block-oriented format below. Map files written before this
+// format existed have no such trailer, so readers can tell the two apart by
+// simply checking for the magic at the expected offset from the end of the
+// file; anything else is treated as the original flat format.
+const (
+	mapFileMagic   uint32 = 0x444d4150 // "DMAP"
+	mapFileVersion uint32 = 1
+
+	// defaultMapBlockSize is used when --map-block-size is unset or zero.
+	defaultMapBlockSize int64 = 1 << 20 // 1 MiB of uncompressed entries per block.
+
+	// mapFileTrailerSize is the fixed size of the trailer written after the
+	// TOC, so a reader can find it by seeking from the end of the file
+	// without having scanned anything else first.
+	mapFileTrailerSize = 4 + 4 + 1 + 8 + 4 // magic, version, compression, tocOffset, numBlocks.
+)
+
+// mapCompression identifies the codec used to compress the blocks of a map
+// file. Entries within a block, and blocks within a file, stay in sorted
+// order regardless of which codec is used.
+type mapCompression byte
+
+const (
+	compressionNone mapCompression = iota
+	compressionGzip
+	compressionZstd
+)
+
+func parseMapCompression(s string) (mapCompression, error) {
+	switch s {
+	case "", "none":
+		return compressionNone, nil
+	case "gzip":
+		return compressionGzip, nil
+	case "zstd":
+		return compressionZstd, nil
+	default:
+		return compressionNone, errors.Errorf("unknown map-compression %q", s)
+	}
+}
+
+// blockTOC is one entry in a map file's table of contents: the key of the
+// first MapEntry in the block (entries are globally sorted, so this is
+// enough to binary search for a starting block) and where the block's
+// compressed bytes live in the file.
+type blockTOC struct {
+	FirstKey  []byte
+	Offset    int64
+	CompLen   int64
+	UncompLen int64
+}
+
+// mapFileWriter packs already-sorted, serialized MapEntry bytes into
+// fixed-size (before compression) blocks, compressing each one as it's
+// flushed, and appends a TOC and trailer on Close.
+type mapFileWriter struct {
+	w           *bufio.Writer
+	compression mapCompression
+	blockSize   int64
+
+	pending      bytes.Buffer
+	pendingFirst []byte
+	offset       int64
+	toc          []blockTOC
+}
+
+func newMapFileWriter(w io.Writer, compression mapCompression, blockSize int64) *mapFileWriter {
+	if blockSize <= 0 {
+		blockSize = defaultMapBlockSize
+	}
+	return &mapFileWriter{
+		w:           bufio.NewWriter(w),
+		compression: compression,
+		blockSize:   blockSize,
+	}
+}
+
+// add appends one length-prefixed, marshaled MapEntry (as produced by the
+// caller) to the current block, flushing the previous block first if it has
+// already reached the configured block size. Entries must be added in
+// sorted order.
+func (mw *mapFileWriter) add(key, entry []byte) error {
+	if int64(mw.pending.Len()) >= mw.blockSize {
+		if err := mw.flush(); err != nil {
+			return err
+		}
+	}
+	if mw.pendingFirst == nil {
+		mw.pendingFirst = append([]byte(nil), key...)
+	}
+	_, err := mw.pending.Write(entry)
+	return err
+}
+
+func (mw *mapFileWriter) flush() error {
+	if mw.pending.Len() == 0 {
+		return nil
+	}
+	raw := mw.pending.Bytes()
+	compLen, err := writeCompressedBlock(mw.w, raw, mw.compression)
+	if err != nil {
+		return err
+	}
+	mw.toc = append(mw.toc, blockTOC{
+		FirstKey:  mw.pendingFirst,
+		Offset:    mw.offset,
+		CompLen:   compLen,
+		UncompLen: int64(len(raw)),
+	})
+	mw.offset += compLen
+	mw.pending.Reset()
+	mw.pendingFirst = nil
+	return nil
+}
+
+// Close flushes the final (possibly partial) block, then writes the TOC and
+// trailer. It does not close the underlying writer.
+func (mw *mapFileWriter) Close() error {
+	if err := mw.flush(); err != nil {
+		return err
+	}
+	tocOffset := mw.offset
+	for _, t := range mw.toc {
+		if err := writeTOCEntry(mw.w, t); err != nil {
+			return err
+		}
+	}
+	for _, v := range []uint32{mapFileMagic, mapFileVersion} {
+		if err := binary.Write(mw.w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	if err := mw.w.WriteByte(byte(mw.compression)); err != nil {
+		return err
+	}
+	if err := binary.Write(mw.w, binary.BigEndian, tocOffset); err != nil {
+		return err
+	}
+	if err := binary.Write(mw.w, binary.BigEndian, uint32(len(mw.toc))); err != nil {
+		return err
+	}
+	return mw.w.Flush()
+}
+
+func writeCompressedBlock(w io.Writer, raw []byte, compression mapCompression) (int64, error) {
+	switch compression {
+	case compressionNone:
+		n, err := w.Write(raw)
+		return int64(n), err
+	case compressionGzip:
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(raw); err != nil {
+			return 0, err
+		}
+		if err := gw.Close(); err != nil {
+			return 0, err
+		}
+		n, err := w.Write(buf.Bytes())
+		return int64(n), err
+	case compressionZstd:
+		compressed, err := zstd.Compress(nil, raw)
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(compressed)
+		return int64(n), err
+	default:
+		return 0, errors.Errorf("unknown map-compression type %v", compression)
+	}
+}
+
+func writeTOCEntry(w *bufio.Writer, t blockTOC) error {
+	var hdr [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdr[:], uint64(len(t.FirstKey)))
+	if _, err := w.Write(hdr[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(t.FirstKey); err != nil {
+		return err
+	}
+	for _, v := range [3]int64{t.Offset, t.CompLen, t.UncompLen} {
+		n := binary.PutUvarint(hdr[:], uint64(v))
+		if _, err := w.Write(hdr[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapFileTOC is the fully-parsed trailer and table of contents of a map
+// file, enough to binary search for a starting block and know how to
+// decompress it.
+type mapFileTOC struct {
+	compression mapCompression
+	blocks      []blockTOC
+}
+
+// readMapFileTOC reads the trailer and TOC from the end of f. ok is false
+// when f doesn't carry the DMAP trailer at all, meaning it's a map file
+// written in the original flat, uncompressed format and should be read
+// sequentially from the start instead.
+func readMapFileTOC(f *os.File) (toc *mapFileTOC, ok bool, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Size() < mapFileTrailerSize {
+		return nil, false, nil
+	}
+
+	trailer := make([]byte, mapFileTrailerSize)
+	if _, err := f.ReadAt(trailer, info.Size()-mapFileTrailerSize); err != nil {
+		return nil, false, err
+	}
+	r := bytes.NewReader(trailer)
+
+	var magic, version uint32
+	x.Check(binary.Read(r, binary.BigEndian, &magic))
+	if magic != mapFileMagic {
+		return nil, false, nil
+	}
+	x.Check(binary.Read(r, binary.BigEndian, &version))
+	if version != mapFileVersion {
+		return nil, false, errors.Errorf("map file %s: unsupported version %d", f.Name(), version)
+	}
+	compressionByte, err := r.ReadByte()
+	if err != nil {
+		return nil, false, err
+	}
+	var tocOffset int64
+	x.Check(binary.Read(r, binary.BigEndian, &tocOffset))
+	var numBlocks uint32
+	x.Check(binary.Read(r, binary.BigEndian, &numBlocks))
+
+	tocBuf := make([]byte, info.Size()-mapFileTrailerSize-tocOffset)
+	if _, err := f.ReadAt(tocBuf, tocOffset); err != nil {
+		return nil, false, err
+	}
+	blocks := make([]blockTOC, 0, numBlocks)
+	for len(tocBuf) > 0 {
+		var t blockTOC
+		var rest []byte
+		t, rest, err = readTOCEntry(tocBuf)
+		if err != nil {
+			return nil, false, err
+		}
+		blocks = append(blocks, t)
+		tocBuf = rest
+	}
+	return &mapFileTOC{compression: mapCompression(compressionByte), blocks: blocks}, true, nil
+}
+
+func readTOCEntry(buf []byte) (t blockTOC, rest []byte, err error) {
+	klen, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return blockTOC{}, nil, errors.Errorf("corrupt map file TOC")
+	}
+	buf = buf[n:]
+	t.FirstKey = append([]byte(nil), buf[:klen]...)
+	buf = buf[klen:]
+
+	vals := make([]int64, 3)
+	for i := range vals {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return blockTOC{}, nil, errors.Errorf("corrupt map file TOC")
+		}
+		vals[i] = int64(v)
+		buf = buf[n:]
+	}
+	t.Offset, t.CompLen, t.UncompLen = vals[0], vals[1], vals[2]
+	return t, buf, nil
+}
+
+// seekBlock returns the index of the block that a k-way merge should resume
+// reading from in order to find key, or the first block if key sorts before
+// every block's FirstKey.
+func (t *mapFileTOC) seekBlock(key []byte) int {
+	idx := sort.Search(len(t.blocks), func(i int) bool {
+		return bytes.Compare(t.blocks[i].FirstKey, key) >= 0
+	})
+	// sort.Search finds the first block whose FirstKey is >= key, but entries
+	// for key may also sit at the end of the preceding block, since FirstKey
+	// only marks where a block begins and one key's entries can span a block
+	// boundary. So resume from the block before it.
+	idx--
+	if idx < 0 {
+		idx = 0
+	}
+	return idx
+}
+
+// blockReader returns a reader that streams the decompressed bytes of the
+// block at the given TOC index, reading directly from f.
+func blockReader(f *os.File, toc *mapFileTOC, idx int) (io.Reader, error) {
+	b := toc.blocks[idx]
+	sr := io.NewSectionReader(f, b.Offset, b.CompLen)
+	switch toc.compression {
+	case compressionNone:
+		return sr, nil
+	case compressionGzip:
+		return gzip.NewReader(sr)
+	case compressionZstd:
+		raw, err := ioutil.ReadAll(sr)
+		if err != nil {
+			return nil, err
+		}
+		decompressed, err := zstd.Decompress(nil, raw)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(decompressed), nil
+	default:
+		return nil, errors.Errorf("unknown map-compression type %v", toc.compression)
+	}
+}
@@ -45,12 +45,20 @@ type shardState struct {
 	// write them to file.
 	entriesBuf []byte
 	mu         sync.Mutex // Allow only 1 write per shard at a time.
+
+	// dedup is a pre-filter that drops entries addMapEntry has already seen
+	// for this shard, before they're ever appended to entriesBuf.
+	dedup *entryDedup
 }
 
 func newMapper(st *state) *mapper {
+	shards := make([]shardState, st.opt.MapShards)
+	for i := range shards {
+		shards[i].dedup = newEntryDedup(st.opt.MapDedupCacheMB)
+	}
 	return &mapper{
 		state:  st,
-		shards: make([]shardState, st.opt.MapShards),
+		shards: shards,
 	}
 }
 
@@ -88,15 +96,9 @@ func (m *mapper) writeMapEntriesToFile(entriesBuf []byte, shardIdx int) {
 		return less(entries[i], entries[j])
 	})
 
-	buf = entriesBuf
-	for _, me := range entries {
-		n := binary.PutUvarint(buf, uint64(me.Size()))
-		buf = buf[n:]
-		n, err := me.MarshalTo(buf)
-		x.Check(err)
-		buf = buf[n:]
-	}
-	x.AssertTrue(len(buf) == 0)
+	var collapsed int
+	entries, collapsed = collapseDuplicateEntries(entries)
+	atomic.AddInt64(&m.prog.dedupCollapsedCount, int64(collapsed))
 
 	fileNum := atomic.AddUint32(&m.mapFileId, 1)
 	filename := filepath.Join(
@@ -106,7 +108,65 @@ func (m *mapper) writeMapEntriesToFile(entriesBuf []byte, shardIdx int) {
 		fmt.Sprintf("%06d.map", fileNum),
 	)
 	x.Check(os.MkdirAll(filepath.Dir(filename), 0755))
-	x.Check(x.WriteFileSync(filename, entriesBuf, 0644))
+	x.Check(m.writeMapFile(filename, entries, entriesBuf))
+}
+
+// writeMapFile packs entries (already sorted) into compressed, TOC-indexed
+// blocks as described in mapFileWriter, reusing scratch as marshaling
+// space so this doesn't allocate per entry. It writes to a temp file next to
+// filename and renames it into place only once every byte is synced to
+// disk, so a crash mid-write never leaves a partial file sitting at the
+// final name for a later run to pick up, matching the durability
+// x.WriteFileSync used to give the old flat-file writer.
+func (m *mapper) writeMapFile(filename string, entries []*intern.MapEntry, scratch []byte) error {
+	tmpName := filename + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			f.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	compression, err := parseMapCompression(m.opt.MapCompression)
+	if err != nil {
+		return err
+	}
+	mw := newMapFileWriter(f, compression, m.opt.MapBlockSize)
+
+	for _, me := range entries {
+		sz := me.Size()
+		need := binary.MaxVarintLen64 + sz
+		if cap(scratch) < need {
+			scratch = make([]byte, need)
+		}
+		scratch = scratch[:need]
+		n := binary.PutUvarint(scratch, uint64(sz))
+		if _, err := me.MarshalTo(scratch[n : n+sz]); err != nil {
+			return err
+		}
+		if err := mw.add(me.Key, scratch[:n+sz]); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		return err
+	}
+	ok = true
+	return nil
 }
 
 func (m *mapper) run() {
@@ -164,12 +224,81 @@ func (m *mapper) addMapEntry(key []byte, p *intern.Posting, shard int) {
 	}
 	sh := &m.shards[shard]
 
+	if fp, content := mapEntryDedupKey(me); sh.dedup.seen(fp, content) {
+		atomic.AddInt64(&m.prog.dedupSkippedCount, 1)
+		return
+	}
+
 	var err error
 	sh.entriesBuf = x.AppendUvarint(sh.entriesBuf, uint64(me.Size()))
 	sh.entriesBuf, err = x.AppendProtoMsg(sh.entriesBuf, me)
 	x.Check(err)
 }
 
+// mapEntryDedupKey returns the fingerprint and verification bytes entryDedup
+// needs for me: content is me's key followed by its posting-equivalent
+// payload (the marshaled Posting proto when present, else the bare UID),
+// and fp is the rolling fingerprint of those same bytes. entryDedup only
+// ever treats fp as a pre-filter, confirming against content before
+// dropping anything, so a fingerprint collision between distinct entries
+// can't cause data loss.
+func mapEntryDedupKey(me *intern.MapEntry) (fp uint64, content []byte) {
+	var payload []byte
+	if me.Posting != nil {
+		pb, err := proto.Marshal(me.Posting)
+		x.Check(err)
+		payload = pb
+	} else {
+		var uidBuf [8]byte
+		binary.BigEndian.PutUint64(uidBuf[:], me.Uid)
+		payload = uidBuf[:]
+	}
+	content = append(append([]byte(nil), me.Key...), payload...)
+	return rollingFingerprint(me.Key, payload), content
+}
+
+// collapseDuplicateEntries drops each entry that is identical to the entry
+// kept just before it: same Key, same UID (UID coming from Posting.Uid when a
+// posting is present, else the bare Uid field) and an equal posting. entries
+// must already be sorted by less(), which orders first by Key and then by
+// that same UID, so duplicates the in-mapper dedup cache missed (e.g.
+// because they were evicted before a repeat showed up) land in the same run
+// of equal (Key, UID) entries. Entries with the same Key and UID but
+// different postings are all kept, and since less() does not order them, a
+// repeat separated from its twin by one of them is kept as well.
+func collapseDuplicateEntries(entries []*intern.MapEntry) ([]*intern.MapEntry, int) {
+	if len(entries) == 0 {
+		return entries, 0
+	}
+	out := entries[:1]
+	var collapsed int
+	for _, me := range entries[1:] {
+		if sameMapEntry(out[len(out)-1], me) {
+			collapsed++
+			continue
+		}
+		out = append(out, me)
+	}
+	return out, collapsed
+}
+
+func sameMapEntry(a, b *intern.MapEntry) bool {
+	if !bytes.Equal(a.Key, b.Key) {
+		return false
+	}
+	aUID, bUID := a.Uid, b.Uid
+	if a.Posting != nil {
+		aUID = a.Posting.Uid
+	}
+	if b.Posting != nil {
+		bUID = b.Posting.Uid
+	}
+	if aUID != bUID {
+		return false
+	}
+	return proto.Equal(a, b)
+}
+
 func (m *mapper) processRDF(rdfLine string) error {
 	nq, err := parseNQuad(rdfLine)
 	if err != nil {
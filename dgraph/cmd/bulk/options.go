@@ -0,0 +1,32 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc.
+ *
+ * This file is available under the Apache License, Version 2.0,
+ * with the Commons Clause restriction.
+ */
+
+package bulk
+
+// options holds the bulk loader's configuration, populated by run.go from
+// the bulk command's flags.
+type options struct {
+	TmpDir       string
+	MapShards    int
+	MapBufSize   int64
+	IgnoreErrors bool
+	ExpandEdges  bool
+	StoreXids    bool
+
+	// MapCompression selects the codec used to compress each map file
+	// block: "none" (default), "gzip", or "zstd". See parseMapCompression.
+	MapCompression string
+
+	// MapBlockSize is the target size, in bytes, of each map file block
+	// before compression. Zero means defaultMapBlockSize.
+	MapBlockSize int64
+
+	// MapDedupCacheMB sizes the per-shard LRU entryDedup uses to drop
+	// repeated postings before they're ever buffered. Zero means
+	// defaultDedupCacheMB.
+	MapDedupCacheMB int
+}
@@ -0,0 +1,28 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc.
+ *
+ * This file is available under the Apache License, Version 2.0,
+ * with the Commons Clause restriction.
+ */
+
+package bulk
+
+// progress holds the counters the mapper and reducer update as bulk load
+// runs; all of them are read and written with the sync/atomic package, so
+// they can be shared across the many mapper/reducer goroutines without a
+// lock.
+type progress struct {
+	rdfCount     int64
+	errCount     int64
+	mapEdgeCount int64
+
+	// dedupSkippedCount counts entries addMapEntry dropped because
+	// entryDedup had already confirmed an identical (key, posting) entry
+	// for that shard.
+	dedupSkippedCount int64
+
+	// dedupCollapsedCount counts additional duplicate entries
+	// collapseDuplicateEntries folded together after the per-shard sort,
+	// catching repeats entryDedup's bounded cache had already evicted.
+	dedupCollapsedCount int64
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc.
+ *
+ * This file is available under the Apache License, Version 2.0,
+ * with the Commons Clause restriction.
+ */
+
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/dgraph-io/dgraph/protos/intern"
+	"github.com/gogo/protobuf/proto"
+)
+
+// mapIterator streams the sorted MapEntry records out of a single .map file,
+// transparently handling both the compressed, TOC-indexed format written by
+// mapFileWriter and the original flat, uncompressed format (detected by the
+// absence of the DMAP trailer). This is what the reduce side of bulk load
+// reads map files back through during the k-way merge.
+type mapIterator struct {
+	f        *os.File
+	toc      *mapFileTOC // nil for the original flat format.
+	blockIdx int
+	r        *bufio.Reader
+}
+
+func newMapIterator(filename string) (*mapIterator, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	toc, ok, err := readMapFileTOC(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	it := &mapIterator{f: f, blockIdx: -1}
+	if ok {
+		it.toc = toc
+		if err := it.openBlock(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return it, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	it.r = bufio.NewReader(f)
+	return it, nil
+}
+
+// openBlock positions the iterator to start decompressing block idx. Once
+// idx runs off the end of the TOC, the iterator reports io.EOF from Next.
+func (it *mapIterator) openBlock(idx int) error {
+	if it.toc == nil || idx >= len(it.toc.blocks) {
+		it.blockIdx = idx
+		it.r = nil
+		return nil
+	}
+	br, err := blockReader(it.f, it.toc, idx)
+	if err != nil {
+		return err
+	}
+	it.blockIdx = idx
+	it.r = bufio.NewReader(br)
+	return nil
+}
+
+// seek repositions the iterator at the block that could contain key,
+// skipping over whole compressed blocks that sort entirely before it
+// instead of decompressing and discarding their entries one at a time. It's
+// a no-op on the original flat format, which has no TOC to skip with.
+func (it *mapIterator) seek(key []byte) error {
+	if it.toc == nil {
+		return nil
+	}
+	return it.openBlock(it.toc.seekBlock(key))
+}
+
+// Next returns the next MapEntry in file order, or io.EOF once exhausted.
+func (it *mapIterator) Next() (*intern.MapEntry, error) {
+	for {
+		if it.r == nil {
+			return nil, io.EOF
+		}
+		sz, err := binary.ReadUvarint(it.r)
+		if err == io.EOF {
+			if it.toc == nil {
+				it.r = nil
+				return nil, io.EOF
+			}
+			if err := it.openBlock(it.blockIdx + 1); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, sz)
+		if _, err := io.ReadFull(it.r, buf); err != nil {
+			return nil, err
+		}
+		me := new(intern.MapEntry)
+		if err := proto.Unmarshal(buf, me); err != nil {
+			return nil, err
+		}
+		return me, nil
+	}
+}
+
+func (it *mapIterator) Close() error {
+	return it.f.Close()
+}
+
+// mergeHeapItem pairs an iterator with the entry it's currently holding, so
+// the heap can order iterators by their next entry without re-reading it.
+type mergeHeapItem struct {
+	it *mapIterator
+	me *intern.MapEntry
+}
+
+type mergeHeap []*mergeHeapItem
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return less(h[i].me, h[j].me) }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeHeapItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// mergeIterator performs a k-way merge of several map files' mapIterators,
+// yielding their combined MapEntry records in the same sorted order
+// writeMapEntriesToFile produced within each individual file.
+type mergeIterator struct {
+	h mergeHeap
+}
+
+// newMergeIterator opens a mapIterator per filename and returns a
+// mergeIterator over all of them. When startKey is non-empty, each
+// mapIterator is seeked to the block that could contain it before the merge
+// begins, and any entries that still sort before startKey (the seeked block
+// may start earlier than the target key) are skipped without being handed
+// to the caller. The caller is responsible for closing the returned
+// iterators (even after the merge is exhausted) once done with them.
+func newMergeIterator(filenames []string, startKey []byte) (*mergeIterator, []*mapIterator, error) {
+	its := make([]*mapIterator, 0, len(filenames))
+	h := make(mergeHeap, 0, len(filenames))
+	for _, filename := range filenames {
+		it, err := newMapIterator(filename)
+		if err != nil {
+			return nil, its, err
+		}
+		its = append(its, it)
+
+		if len(startKey) > 0 {
+			if err := it.seek(startKey); err != nil {
+				return nil, its, err
+			}
+		}
+
+		me, err := it.Next()
+		for err == nil && bytes.Compare(me.Key, startKey) < 0 {
+			me, err = it.Next()
+		}
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, its, err
+		}
+		h = append(h, &mergeHeapItem{it: it, me: me})
+	}
+	heap.Init(&h)
+	return &mergeIterator{h: h}, its, nil
+}
+
+// mergeShard runs the k-way merge across filenames bounded to the half-open
+// key range [start, end), closing every mapIterator it opened before
+// returning. end may be nil to mean "no upper bound" (the last reduce
+// shard). This is the real caller newMergeIterator's startKey skip-range is
+// built for: a reducer only cares about the slice of the global key space
+// its shard owns, so seeking every input file straight to start avoids
+// decompressing and discarding every block that belongs to earlier shards.
+func mergeShard(filenames []string, start, end []byte) ([]*intern.MapEntry, error) {
+	mi, its, err := newMergeIterator(filenames, start)
+	defer func() {
+		for _, it := range its {
+			it.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*intern.MapEntry
+	for {
+		me, err := mi.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(end) > 0 && bytes.Compare(me.Key, end) >= 0 {
+			break
+		}
+		entries = append(entries, me)
+	}
+	return entries, nil
+}
+
+// Next returns the next MapEntry across all merged files, in sorted order,
+// or io.EOF once every file is exhausted.
+func (mi *mergeIterator) Next() (*intern.MapEntry, error) {
+	if mi.h.Len() == 0 {
+		return nil, io.EOF
+	}
+	top := mi.h[0]
+	me := top.me
+
+	next, err := top.it.Next()
+	switch {
+	case err == io.EOF:
+		heap.Pop(&mi.h)
+	case err != nil:
+		return nil, err
+	default:
+		top.me = next
+		heap.Fix(&mi.h, 0)
+	}
+	return me, nil
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc.
+ *
+ * This file is available under the Apache License, Version 2.0,
+ * with the Commons Clause restriction.
+ */
+
+package bulk
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/dgraph/protos/intern"
+)
+
+// writeTestMapFile writes keys (already in the order they should appear in
+// the file) as MapEntry records through mapFileWriter, the same writer
+// mapper.writeMapFile uses, so the test reads back exactly what bulk load
+// would have produced.
+func writeTestMapFile(t *testing.T, dir, name string, compression mapCompression, blockSize int64, keys []string) string {
+	t.Helper()
+
+	filename := filepath.Join(dir, name)
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	mw := newMapFileWriter(f, compression, blockSize)
+	for i, k := range keys {
+		me := &intern.MapEntry{Key: []byte(k), Uid: uint64(i + 1)}
+		sz := me.Size()
+		buf := make([]byte, binary.MaxVarintLen64+sz)
+		n := binary.PutUvarint(buf, uint64(sz))
+		if _, err := me.MarshalTo(buf[n:]); err != nil {
+			t.Fatal(err)
+		}
+		if err := mw.add(me.Key, buf[:n+sz]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestMapIteratorRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapfile_roundtrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, compression := range []mapCompression{compressionNone, compressionGzip} {
+		filename := writeTestMapFile(t, dir, "0001.map", compression, 16, keys)
+
+		it, err := newMapIterator(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for {
+			me, err := it.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, string(me.Key))
+		}
+		it.Close()
+
+		if len(got) != len(keys) {
+			t.Fatalf("compression %v: got %d entries, want %d", compression, len(got), len(keys))
+		}
+		for i := range keys {
+			if got[i] != keys[i] {
+				t.Fatalf("compression %v: entry %d: got %q, want %q", compression, i, got[i], keys[i])
+			}
+		}
+	}
+}
+
+func TestMapIteratorSeekSkipsBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapfile_seek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	filename := writeTestMapFile(t, dir, "0001.map", compressionNone, 16, keys)
+
+	it, err := newMapIterator(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	if err := it.seek([]byte("f")); err != nil {
+		t.Fatal(err)
+	}
+	me, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(me.Key) > "f" {
+		t.Fatalf("seek(%q) landed past the target block: first key read back was %q", "f", me.Key)
+	}
+}
+
+func TestMergeIteratorOrdersAcrossFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapfile_merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f1 := writeTestMapFile(t, dir, "0001.map", compressionNone, 1<<20, []string{"a", "c", "e"})
+	f2 := writeTestMapFile(t, dir, "0002.map", compressionGzip, 1<<20, []string{"b", "d", "f"})
+
+	mi, its, err := newMergeIterator([]string{f1, f2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, it := range its {
+			it.Close()
+		}
+	}()
+
+	var got []string
+	for {
+		me, err := mi.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(me.Key))
+	}
+
+	want := []string{"a", "b", "c", "d", "e", "f"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMergeShardSkipsBlocksOutsideRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapfile_mergeshard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	f1 := writeTestMapFile(t, dir, "0001.map", compressionNone, 16, keys)
+	f2 := writeTestMapFile(t, dir, "0002.map", compressionNone, 16, []string{"a1", "c1", "f1"})
+
+	entries, err := mergeShard([]string{f1, f2}, []byte("c"), []byte("g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, me := range entries {
+		got = append(got, string(me.Key))
+	}
+	want := []string{"c", "c1", "d", "e", "f", "f1"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMergeShardNilEndCoversRest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapfile_mergeshard_tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f1 := writeTestMapFile(t, dir, "0001.map", compressionNone, 16, []string{"a", "b", "c", "d", "e"})
+
+	entries, err := mergeShard([]string{f1}, []byte("c"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, me := range entries {
+		got = append(got, string(me.Key))
+	}
+	want := []string{"c", "d", "e"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright 2017-2018 Dgraph Labs, Inc.
+ *
+ * This file is available under the Apache License, Version 2.0,
+ * with the Commons Clause restriction.
+ */
+
+package bulk
+
+import (
+	"github.com/dgraph-io/dgraph/x"
+	"github.com/spf13/cobra"
+)
+
+// Bulk is the "dgraph bulk" subcommand.
+var Bulk x.SubCommand
+
+var opt options
+
+func init() {
+	Bulk.Cmd = &cobra.Command{
+		Use:   "bulk",
+		Short: "Run Dgraph Bulk Loader",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Does nothing: this package has no entrypoint that starts the
+			// map/reduce pipeline from opt.
+		},
+	}
+	Bulk.EnvPrefix = "DGRAPH_BULK"
+
+	flag := Bulk.Cmd.Flags()
+	flag.StringVar(&opt.TmpDir, "tmp", "tmp", "Temp directory used to use for on-disk scratch space.")
+	flag.IntVar(&opt.MapShards, "map_shards", 1,
+		"Number of map output shards. Must be greater than or equal to the number of reduce shards.")
+	flag.Int64Var(&opt.MapBufSize, "mapoutput_mb", 2048,
+		"The estimated size of each map file output. Increasing this increases memory usage.")
+	flag.BoolVar(&opt.IgnoreErrors, "ignore_errors", false, "Ignore parsing errors in rdf files.")
+	flag.BoolVar(&opt.ExpandEdges, "expand_edges", true,
+		"Generate edges that allow nodes to be expanded using _predicate_ or expand(...).")
+	flag.BoolVar(&opt.StoreXids, "store_xids", false, "Store xids by adding an xid edge to each node.")
+
+	flag.StringVar(&opt.MapCompression, "map-compression", "none",
+		"Codec used to compress map file blocks: none, gzip, or zstd.")
+	flag.Int64Var(&opt.MapBlockSize, "map-block-size", defaultMapBlockSize,
+		"Target size, in bytes, of each map file block before compression.")
+	flag.IntVar(&opt.MapDedupCacheMB, "map-dedup-cache-mb", defaultDedupCacheMB,
+		"Size, in MB, of the per-shard in-mapper cache used to drop repeated postings.")
+}